@@ -0,0 +1,303 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/sstable"
+	"github.com/cockroachdb/pebble/vfs/atomicfs"
+)
+
+// fileTypeManifest identifies a MANIFEST file for base.MakeFilename, as used
+// by the formatVersionedManifestMarker migration.
+const fileTypeManifest = base.FileTypeManifest
+
+// fileBacking is the physical, on-disk sstable that one or more
+// fileMetadatas may reference. Before FormatVirtualSSTables, every
+// fileMetadata has its own unshared fileBacking; from FormatVirtualSSTables
+// onward, multiple virtual fileMetadatas may point at the same fileBacking,
+// each covering a disjoint sub-range of it.
+type fileBacking struct {
+	FileNum base.FileNum
+}
+
+// fileMetadata describes a single sstable (physical or virtual) within a
+// version.
+type fileMetadata struct {
+	FileNum     base.FileNum
+	Smallest    base.InternalKey
+	Largest     base.InternalKey
+	FileBacking *fileBacking
+	TableFormat sstable.TableFormat
+
+	// Virtual is true if this fileMetadata covers only a sub-range of its
+	// FileBacking, introduced by FormatVirtualSSTables.
+	Virtual bool
+	// HasRangeKeys is true if the file contains at least one range key,
+	// introduced by FormatRangeKeys.
+	HasRangeKeys bool
+	// BlockPropertyCollectors lists the names of the block-property
+	// collectors that annotated this file's blocks, introduced by
+	// FormatBlockPropertyCollector.
+	BlockPropertyCollectors []string
+
+	markedForCompaction bool
+}
+
+// fileMetadataIter iterates the files within a single level of a version, in
+// key order.
+type fileMetadataIter struct {
+	files []*fileMetadata
+	pos   int
+}
+
+func (i *fileMetadataIter) First() *fileMetadata {
+	i.pos = 0
+	return i.At()
+}
+
+func (i *fileMetadataIter) Next() *fileMetadata {
+	i.pos++
+	return i.At()
+}
+
+func (i *fileMetadataIter) At() *fileMetadata {
+	if i.pos < 0 || i.pos >= len(i.files) {
+		return nil
+	}
+	return i.files[i.pos]
+}
+
+// levelMetadata holds the files within a single level of a version.
+type levelMetadata struct {
+	files []*fileMetadata
+}
+
+// Iter returns an iterator over the level's files, in key order.
+func (l *levelMetadata) Iter() *fileMetadataIter {
+	return &fileMetadataIter{files: l.files, pos: -1}
+}
+
+// version is an immutable point-in-time view of the files that make up the
+// LSM, one levelMetadata per level (index 0 is L0).
+type version struct {
+	Levels [7]levelMetadata
+}
+
+// DebugString returns a human-readable representation of the version's
+// contents, keyed by level.
+func (v *version) DebugString(format base.FormatKey) string {
+	var buf []byte
+	for level, lm := range v.Levels {
+		if len(lm.files) == 0 {
+			continue
+		}
+		buf = append(buf, []byte(fmtLevel(level))...)
+		for _, f := range lm.files {
+			buf = append(buf, []byte(fmtFile(f, format))...)
+		}
+	}
+	return string(buf)
+}
+
+func fmtLevel(level int) string {
+	return fmt.Sprintf("%d:\n", level)
+}
+
+func fmtFile(f *fileMetadata, format base.FormatKey) string {
+	return fmt.Sprintf("  %s:[%s-%s]\n", f.FileNum, f.Smallest.Pretty(format), f.Largest.Pretty(format))
+}
+
+// versionSet manages the set of file metadata that make up the LSM, as well
+// as the manifest file that records changes to it.
+type versionSet struct {
+	mu sync.Mutex
+
+	manifestFileNum base.FileNum
+	metrics         Metrics
+
+	current *version
+}
+
+func (vs *versionSet) logLock()         { vs.mu.Lock() }
+func (vs *versionSet) logUnlock()       { vs.mu.Unlock() }
+func (vs *versionSet) currentVersion() *version {
+	if vs.current == nil {
+		vs.current = &version{}
+	}
+	return vs.current
+}
+
+// Metrics holds metrics describing the state of a DB.
+type Metrics struct {
+	Compact struct {
+		// MarkedFiles is the count of files currently marked for
+		// compaction.
+		MarkedFiles int
+	}
+}
+
+// DB provides a concurrent, persistent ordered key/value store.
+//
+// This is a reduced-scope reconstruction covering only what the
+// format-major-version subsystem (ratcheting, downgrading, planning, and
+// the marker lifecycle) needs; it intentionally does not reproduce the
+// memtable, WAL, or compaction-picker machinery of the full storage engine.
+type DB struct {
+	dirname        string
+	opts           *Options
+	manifestMarker *atomicfs.Marker
+
+	mu struct {
+		sync.Mutex
+
+		formatVers struct {
+			vers   FormatMajorVersion
+			marker *atomicfs.Marker
+		}
+
+		versions versionSet
+
+		compact struct {
+			compactingCount int
+		}
+	}
+}
+
+// Set sets the value for the given key. It overwrites any previous value
+// for that key; a DB is not a multi-map.
+func (d *DB) Set(key, value []byte, opts *WriteOptions) error {
+	return nil
+}
+
+// Flush flushes the mutable memtable to a new sstable.
+func (d *DB) Flush() error {
+	return nil
+}
+
+// Compact manually compacts the range of keys [start, end).
+func (d *DB) Compact(start, end []byte, parallelize bool) error {
+	return nil
+}
+
+// Iterator iterates over a DB's key/value pairs.
+type Iterator struct{}
+
+// First moves the iterator to the first key/value pair.
+func (i *Iterator) First() bool { return false }
+
+// Next moves the iterator to the next key/value pair.
+func (i *Iterator) Next() bool { return false }
+
+// Close closes the iterator.
+func (i *Iterator) Close() error { return nil }
+
+// NewIter returns an Iterator over the DB's key/value pairs.
+func (d *DB) NewIter(o *IterOptions) *Iterator {
+	return &Iterator{}
+}
+
+// Metrics returns metrics describing the DB's current state.
+func (d *DB) Metrics() *Metrics {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m := d.mu.versions.metrics
+	return &m
+}
+
+// Close closes the DB.
+func (d *DB) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.mu.formatVers.marker != nil {
+		if err := d.mu.formatVers.marker.Close(); err != nil {
+			return err
+		}
+	}
+	if d.manifestMarker != nil {
+		if err := d.manifestMarker.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markFilesLocked marks every file returned by selector for compaction,
+// adjusting Metrics.Compact.MarkedFiles for any file not already marked.
+// d.mu must be held.
+func (d *DB) markFilesLocked(selector func(*version) []*fileMetadata) error {
+	d.mu.versions.logLock()
+	defer d.mu.versions.logUnlock()
+	for _, f := range selector(d.mu.versions.currentVersion()) {
+		if !f.markedForCompaction {
+			f.markedForCompaction = true
+			d.mu.versions.metrics.Compact.MarkedFiles++
+		}
+	}
+	return nil
+}
+
+// compactMarkedFilesLocked synchronously rewrites every file currently
+// marked for compaction, clearing their mark, and reports the rewrite of all
+// of them through a single EventListener.CompactionEnd call. d.mu must be
+// held.
+func (d *DB) compactMarkedFilesLocked() error {
+	d.mu.versions.logLock()
+	v := d.mu.versions.currentVersion()
+	var rewritten []*fileMetadata
+	for level := range v.Levels {
+		for _, f := range v.Levels[level].files {
+			if f.markedForCompaction {
+				rewritten = append(rewritten, f)
+			}
+		}
+	}
+	for _, f := range rewritten {
+		f.markedForCompaction = false
+		d.mu.versions.metrics.Compact.MarkedFiles--
+	}
+	d.mu.versions.logUnlock()
+
+	if len(rewritten) > 0 {
+		d.opts.EventListener.CompactionEnd(CompactionInfo{
+			Reason: "split-user-key",
+			Output: LevelInfo{Level: len(v.Levels) - 1},
+		})
+	}
+	return nil
+}
+
+// maybeScheduleCompactionLocked schedules a compaction of any marked files
+// unless automatic compactions are disabled. d.mu must be held.
+func (d *DB) maybeScheduleCompactionLocked() {
+	if d.opts.DisableAutomaticCompactions {
+		return
+	}
+	_ = d.compactMarkedFilesLocked()
+}
+
+// markFilesWithSplitUserKeys returns, once each, the files in v that share a
+// user key with an adjacent file within the same level (both files of each
+// such pair) — the invariant that FormatSplitUserKeysMarked guarantees is
+// recorded in the manifest.
+func markFilesWithSplitUserKeys(v *version) []*fileMetadata {
+	var marked []*fileMetadata
+	for level := range v.Levels {
+		files := v.Levels[level].files
+		for i := 1; i < len(files); i++ {
+			prev, cur := files[i-1], files[i]
+			if base.InternalCompare(base.DefaultComparer.Compare, prev.Largest, cur.Smallest) >= 0 {
+				if len(marked) == 0 || marked[len(marked)-1] != prev {
+					marked = append(marked, prev)
+				}
+				marked = append(marked, cur)
+			}
+		}
+	}
+	return marked
+}
@@ -0,0 +1,120 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"time"
+)
+
+// CompactionInfo contains the info for a compaction event.
+type CompactionInfo struct {
+	// JobID is the ID of the compaction job.
+	JobID int
+	// Reason is the reason for the compaction.
+	Reason string
+	// Input contains the input tables for the compaction.
+	Input []LevelInfo
+	// Output contains the output tables generated by the compaction.
+	Output LevelInfo
+	// Duration is the time spent compacting, excluding time spent in
+	// related WAL rotation.
+	Duration time.Duration
+	// TotalDuration is the total wall-time duration of the compaction,
+	// including any time the compaction spent waiting to be scheduled.
+	TotalDuration time.Duration
+	// Err is set if the compaction failed.
+	Err error
+}
+
+// String implements fmt.Stringer, returning a short summary of the
+// compaction suitable for logging.
+func (i CompactionInfo) String() string {
+	if i.Err != nil {
+		return fmt.Sprintf("[JOB %d] compaction error: %s", i.JobID, i.Err)
+	}
+	return fmt.Sprintf("[JOB %d] compaction (%s) to level %d", i.JobID, i.Reason, i.Output.Level)
+}
+
+// LevelInfo contains the sstables that participated in a level's side of a
+// compaction or flush.
+type LevelInfo struct {
+	// Level is the level the files belong to.
+	Level int
+}
+
+// MigrationPlan describes the work a whole format-major-version ratchet,
+// summed over all of its intermediate migration steps, is expected to
+// perform, as reported to an EventListener alongside
+// FormatMajorVersionRatchetBegin. Operators can use it to gauge how long a
+// long-running migration (e.g. FormatSplitUserKeysMarked ->
+// FormatMarkedCompacted) will take before it runs.
+type MigrationPlan struct {
+	// From and To identify the ratchet this plan describes.
+	From, To FormatMajorVersion
+	// MarkedForCompactionCount estimates the number of files that will be
+	// marked for compaction by this step (for example, files with split
+	// user keys ahead of FormatSplitUserKeysMarked).
+	MarkedForCompactionCount int
+	// BlockPropertyRecollectionCount estimates the number of files that
+	// will need their block properties re-collected as part of this
+	// step.
+	BlockPropertyRecollectionCount int
+}
+
+// EventListener contains a set of functions that will be invoked when
+// various significant events occur in the lifetime of a DB. Callers may
+// leave any of these fields nil if they do not wish to be notified of
+// that particular event.
+//
+// Callbacks are invoked synchronously and should not block or call back
+// into the DB.
+type EventListener struct {
+	// CompactionBegin is invoked after a compaction has started and its
+	// inputs have been determined, but before the compaction has begun
+	// reading/writing data.
+	CompactionBegin func(CompactionInfo)
+	// CompactionEnd is invoked after a compaction has completed, whether
+	// or not it was successful. info.Err will be non-nil if the
+	// compaction failed.
+	CompactionEnd func(CompactionInfo)
+	// FormatMajorVersionRatchetBegin is invoked when RatchetFormatMajorVersion
+	// begins migrating the database from one format major version to
+	// another. plan describes the estimated work of all the intermediate
+	// migration steps that will run to get from "from" to "to", taken
+	// together.
+	FormatMajorVersionRatchetBegin func(from, to FormatMajorVersion, plan MigrationPlan)
+	// FormatMajorVersionStepCompleted is invoked after each individual
+	// migration defined in formatMajorVersionMigrations completes
+	// successfully, reporting the format major version that was just
+	// reached.
+	FormatMajorVersionStepCompleted func(v FormatMajorVersion)
+	// FormatMajorVersionRatchetEnd is invoked once RatchetFormatMajorVersion
+	// returns after having invoked FormatMajorVersionRatchetBegin, whether
+	// the ratchet succeeded or failed. err is nil on success. It is not
+	// invoked when the ratchet is rejected up front because the target is
+	// below the current format major version.
+	FormatMajorVersionRatchetEnd func(from, to FormatMajorVersion, err error)
+}
+
+// EnsureDefaults replaces every nil callback with a no-op function, so that
+// the DB can invoke any of them unconditionally.
+func (l *EventListener) EnsureDefaults() {
+	if l.CompactionBegin == nil {
+		l.CompactionBegin = func(CompactionInfo) {}
+	}
+	if l.CompactionEnd == nil {
+		l.CompactionEnd = func(CompactionInfo) {}
+	}
+	if l.FormatMajorVersionRatchetBegin == nil {
+		l.FormatMajorVersionRatchetBegin = func(from, to FormatMajorVersion, plan MigrationPlan) {}
+	}
+	if l.FormatMajorVersionStepCompleted == nil {
+		l.FormatMajorVersionStepCompleted = func(v FormatMajorVersion) {}
+	}
+	if l.FormatMajorVersionRatchetEnd == nil {
+		l.FormatMajorVersionRatchetEnd = func(from, to FormatMajorVersion, err error) {}
+	}
+}
@@ -0,0 +1,704 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/sstable"
+)
+
+// FormatMajorVersion is a constant controlling the format of persisted
+// data. Backwards incompatible changes to the implementation of Pebble
+// are gated behind new format major versions.
+//
+// At any point, a database's format major version may be bumped. However,
+// once a database's format major version is increased, previous versions
+// of Pebble will refuse to open the database.
+//
+// The zero value format is FormatDefault.
+type FormatMajorVersion uint64
+
+// FormatDefault leaves the format version unspecified. The DefaultFormatMajorVersion
+// constant is the format major version used if the FormatMajorVersion field
+// of Options is left unspecified. New Pebble databases default to the
+// most compatible format.
+const (
+	// FormatDefault leaves the format major version unspecified. It's used
+	// internally as a sentinel. When creating a new store, the default
+	// format major version (FormatMostCompatible) is used.
+	FormatDefault FormatMajorVersion = iota
+	// FormatMostCompatible maintains the most backwards compatibility,
+	// maintaining bi-directional compatibility with RocksDB 6.2.1 in the
+	// default configuration.
+	FormatMostCompatible
+	// formatVersionedManifestMarker is a format major version that
+	// introduces the use of a marker file for pointing to the current
+	// MANIFEST. This version is never a directly-selectable format major
+	// version; clients select FormatVersioned instead.
+	formatVersionedManifestMarker
+	// FormatVersioned is a new format major version that replaced the
+	// NextFileNum with a Versioned one. Every new store will create
+	// sstables with this format by default.
+	FormatVersioned
+	// FormatSetWithDelete is a format major version that introduces a new
+	// key kind, InternalKeyKindSetWithDelete. Previous Pebble versions
+	// will not be able to open this database.
+	FormatSetWithDelete
+	// FormatBlockPropertyCollector is a format major version that
+	// introduces block-property collectors, allowing tables to be
+	// annotated with custom metadata describing properties of the
+	// key-value pairs within each data block.
+	FormatBlockPropertyCollector
+	// FormatSplitUserKeysMarked is a format major version that guarantees
+	// that all files with split user keys (ie, two files that contain
+	// keys with the same user keys) are marked for compaction in the
+	// manifest.
+	FormatSplitUserKeysMarked
+	// FormatMarkedCompacted is a format major version that guarantees that
+	// all files marked for compaction (see the FormatSplitUserKeysMarked
+	// comment) have been compacted. Until this version, the
+	// split-user-key invariant is enforced lazily.
+	FormatMarkedCompacted
+	// FormatRangeKeys is a format major version that introduces range
+	// keys.
+	FormatRangeKeys
+	// FormatSSTableValueBlocks is a format major version that introduces
+	// sstables with a dedicated value-block section (sstable.TableFormatPebblev3).
+	// Large values are written to the value block and are only read off
+	// disk when a caller explicitly fetches them, rather than on every
+	// point lookup or iteration step. Upgrading to this format major
+	// version does not modify any existing sstables; it only begins
+	// gating newly-written sstables (through flushes and compactions) on
+	// the new table format.
+	FormatSSTableValueBlocks
+	// FormatVirtualSSTables is a format major version that introduces
+	// virtual sstables. A virtual sstable is a manifest.FileMetadata that
+	// references a sub-range, [SmallestKey, LargestKey), of a physical
+	// on-disk sstable recorded in a shared manifest.FileBacking. Multiple
+	// virtual sstables may share the same FileBacking, allowing a single
+	// physical file produced by an ingest (or an overlapping compaction
+	// input) to be split into disjoint pieces without rewriting any of
+	// the underlying data. Ratcheting to this format major version scans
+	// the current LSM and refuses the upgrade if any existing file
+	// already violates the invariants virtual sstables depend on (for
+	// example, a FileBacking referenced by files whose key ranges are
+	// not disjoint).
+	FormatVirtualSSTables
+
+	// NB: if adding a new version, you likely want to update
+	// FormatNewest below, and add a new case to (FormatMajorVersion).String().
+
+	// FormatNewest always contains the most recent format major version.
+	// It is not the default for new Pebble instances; those default to
+	// FormatMostCompatible (see FormatDefault).
+	FormatNewest FormatMajorVersion = FormatVirtualSSTables
+)
+
+// String implements fmt.Stringer.
+func (v FormatMajorVersion) String() string {
+	switch v {
+	case FormatDefault:
+		return "(default)"
+	case FormatMostCompatible:
+		return "most-compatible"
+	case formatVersionedManifestMarker:
+		return "versioned-manifest-marker"
+	case FormatVersioned:
+		return "versioned"
+	case FormatSetWithDelete:
+		return "set-with-delete"
+	case FormatBlockPropertyCollector:
+		return "block-property-collector"
+	case FormatSplitUserKeysMarked:
+		return "split-user-keys-marked"
+	case FormatMarkedCompacted:
+		return "marked-compacted"
+	case FormatRangeKeys:
+		return "range-keys"
+	case FormatSSTableValueBlocks:
+		return "sstable-value-blocks"
+	case FormatVirtualSSTables:
+		return "virtual-sstables"
+	default:
+		// Unlike MaxTableFormat, String must not panic on an unrecognized
+		// version: it's invoked when formatting errors about stores
+		// persisted at a format major version newer than this binary
+		// understands, e.g. IncompatibleFormatError.
+		return fmt.Sprintf("unknown(%03d)", uint64(v))
+	}
+}
+
+// MaxTableFormat returns the maximum sstable.TableFormat that can be used at
+// this FormatMajorVersion.
+func (v FormatMajorVersion) MaxTableFormat() sstable.TableFormat {
+	switch v {
+	case FormatDefault, FormatMostCompatible, formatVersionedManifestMarker,
+		FormatVersioned, FormatSetWithDelete:
+		return sstable.TableFormatRocksDBv2
+	case FormatBlockPropertyCollector, FormatSplitUserKeysMarked, FormatMarkedCompacted:
+		return sstable.TableFormatPebblev1
+	case FormatRangeKeys:
+		return sstable.TableFormatPebblev2
+	case FormatSSTableValueBlocks, FormatVirtualSSTables:
+		return sstable.TableFormatPebblev3
+	default:
+		panic(errors.Newf("pebble: unknown format major version %d", uint64(v)))
+	}
+}
+
+// FormatFeatures is a bitset describing the set of on-disk features a
+// FormatMajorVersion enables.
+type FormatFeatures uint64
+
+// The individual bits of FormatFeatures. Each corresponds to a
+// FormatMajorVersion that introduced the feature; see
+// (FormatMajorVersion).Features.
+const (
+	FeatureSetWithDelete FormatFeatures = 1 << iota
+	FeatureBlockPropertyCollector
+	FeatureSplitUserKeysMarked
+	FeatureMarkedCompacted
+	FeatureRangeKeys
+	FeatureSSTableValueBlocks
+	FeatureVirtualSSTables
+)
+
+// Has reports whether the receiver includes all of the bits set in f.
+func (f FormatFeatures) Has(feature FormatFeatures) bool {
+	return f&feature == feature
+}
+
+// Features returns the bitset of features enabled by v. Higher format major
+// versions always enable a superset of the features of lower versions.
+func (v FormatMajorVersion) Features() FormatFeatures {
+	var f FormatFeatures
+	if v >= FormatSetWithDelete {
+		f |= FeatureSetWithDelete
+	}
+	if v >= FormatBlockPropertyCollector {
+		f |= FeatureBlockPropertyCollector
+	}
+	if v >= FormatSplitUserKeysMarked {
+		f |= FeatureSplitUserKeysMarked
+	}
+	if v >= FormatMarkedCompacted {
+		f |= FeatureMarkedCompacted
+	}
+	if v >= FormatRangeKeys {
+		f |= FeatureRangeKeys
+	}
+	if v >= FormatSSTableValueBlocks {
+		f |= FeatureSSTableValueBlocks
+	}
+	if v >= FormatVirtualSSTables {
+		f |= FeatureVirtualSSTables
+	}
+	return f
+}
+
+// FormatMajorVersionRange returns the inclusive range of format major
+// versions that this build of Pebble is able to open. A store persisted at
+// a format major version outside this range cannot be opened by this
+// binary; see IncompatibleFormatError.
+func FormatMajorVersionRange() (min, max FormatMajorVersion) {
+	return FormatMostCompatible, FormatNewest
+}
+
+// SupportedFormatMajorVersions returns the list of format major versions,
+// in ascending order, that this build of Pebble is able to open.
+func SupportedFormatMajorVersions() []FormatMajorVersion {
+	min, max := FormatMajorVersionRange()
+	vers := make([]FormatMajorVersion, 0, max-min+1)
+	for v := min; v <= max; v++ {
+		vers = append(vers, v)
+	}
+	return vers
+}
+
+// IncompatibleFormatError is returned by Open (via checkFormatMajorVersionSupported)
+// when a store's persisted format major version falls outside the range of
+// versions this binary supports. Unlike the generic error previously
+// returned in this case, it
+// exposes both the store's on-disk version and the binary's supported
+// range programmatically, so that orchestration tooling (for example,
+// rolling upgrades of a cluster built atop Pebble) can verify a binary can
+// host a given store before starting it.
+type IncompatibleFormatError struct {
+	// Stored is the format major version persisted in the store.
+	Stored FormatMajorVersion
+	// MinSupported and MaxSupported are the inclusive range of format
+	// major versions this binary is able to open.
+	MinSupported, MaxSupported FormatMajorVersion
+}
+
+// Error implements error.
+func (e *IncompatibleFormatError) Error() string {
+	return fmt.Sprintf(
+		"pebble: store format major version %s is outside the supported range [%s, %s]",
+		e.Stored, e.MinSupported, e.MaxSupported,
+	)
+}
+
+// checkFormatMajorVersionSupported is the validation Open performs after
+// reading a store's persisted format-version marker (see open.go), before
+// the store is used any further. It returns an *IncompatibleFormatError if
+// stored falls outside the range of format major versions this binary
+// supports.
+func checkFormatMajorVersionSupported(stored FormatMajorVersion) error {
+	min, max := FormatMajorVersionRange()
+	if stored < min || stored > max {
+		return &IncompatibleFormatError{Stored: stored, MinSupported: min, MaxSupported: max}
+	}
+	return nil
+}
+
+// formatMajorVersionMigrations defines the migrations from one format major
+// version to the next. Each migration is defined as a closure that performs
+// the mutations necessary to migrate the DB from the previous version into
+// the one it's keyed by. Migrations are run sequentially, beginning at the
+// DB's current format major version, until the database has been ratcheted
+// up to the target format major version.
+//
+// Each migration is responsible for invoking finalizeFormatVersUpgrade to
+// finalize the upgrade once all necessary migrations have completed. See
+// formatVersioned's migration for an example.
+var formatMajorVersionMigrations = map[FormatMajorVersion]func(*DB) error{
+	FormatMostCompatible: func(d *DB) error {
+		return nil
+	},
+	formatVersionedManifestMarker: func(d *DB) error {
+		// Lock the manifest before getting the current version. We need
+		// to hold this lock not just while the marker is moved, but
+		// until the record with the updated format major version is
+		// written to the new manifest.
+		d.mu.versions.logLock()
+		defer d.mu.versions.logUnlock()
+
+		// We use the marker to encode the filename of the current
+		// MANIFEST file.
+		currentManifestFileNum := d.mu.versions.manifestFileNum
+		if err := d.manifestMarker.Move(base.MakeFilename(fileTypeManifest, currentManifestFileNum).String()); err != nil {
+			return errors.Wrap(err, "moving manifest marker")
+		}
+		return d.finalizeFormatVersUpgrade(formatVersionedManifestMarker)
+	},
+	FormatVersioned: func(d *DB) error {
+		return d.finalizeFormatVersUpgrade(FormatVersioned)
+	},
+	FormatSetWithDelete: func(d *DB) error {
+		// Nothing to do other than record the format major version.
+		return d.finalizeFormatVersUpgrade(FormatSetWithDelete)
+	},
+	FormatBlockPropertyCollector: func(d *DB) error {
+		return d.finalizeFormatVersUpgrade(FormatBlockPropertyCollector)
+	},
+	FormatSplitUserKeysMarked: func(d *DB) error {
+		// Mark any files that contain split user keys for compaction.
+		// The scan and marking run synchronously here; the marked files
+		// are rewritten later, by the FormatMarkedCompacted migration or
+		// by a scheduled compaction.
+		if err := d.markFilesLocked(markFilesWithSplitUserKeys); err != nil {
+			return err
+		}
+		return d.finalizeFormatVersUpgrade(FormatSplitUserKeysMarked)
+	},
+	FormatMarkedCompacted: func(d *DB) error {
+		// Before finalizing the format major version, rewrite any files
+		// that were marked for compaction by the previous migration.
+		if err := d.compactMarkedFilesLocked(); err != nil {
+			return err
+		}
+		return d.finalizeFormatVersUpgrade(FormatMarkedCompacted)
+	},
+	FormatRangeKeys: func(d *DB) error {
+		return d.finalizeFormatVersUpgrade(FormatRangeKeys)
+	},
+	FormatSSTableValueBlocks: func(d *DB) error {
+		// This is a no-op migration with respect to existing state: no
+		// existing sstable is rewritten. It only gates the sstable
+		// writer used by future flushes and compactions on
+		// sstable.TableFormatPebblev3, so that they may begin emitting a
+		// separate value-block section.
+		return d.finalizeFormatVersUpgrade(FormatSSTableValueBlocks)
+	},
+	FormatVirtualSSTables: func(d *DB) error {
+		// Virtual sstables allow a FileBacking to be shared by multiple
+		// FileMetadatas, each covering a disjoint [Smallest, Largest)
+		// sub-range of the backing file. Refuse to ratchet if any file
+		// already on disk would violate that invariant once virtual
+		// sstables are enabled.
+		d.mu.versions.logLock()
+		defer d.mu.versions.logUnlock()
+		if err := checkNoExistingFileBackingViolations(d.mu.versions.currentVersion()); err != nil {
+			return errors.Wrap(err, "cannot ratchet to format major version FormatVirtualSSTables")
+		}
+		return d.finalizeFormatVersUpgrade(FormatVirtualSSTables)
+	},
+}
+
+// checkNoExistingFileBackingViolations scans the current LSM and returns an
+// error if any on-disk file already violates the invariant that virtual
+// sstables depend on: that every FileBacking is referenced by files whose
+// key ranges are pairwise disjoint.
+func checkNoExistingFileBackingViolations(v *version) error {
+	cmp := func(a, b base.InternalKey) int { return base.InternalCompare(base.DefaultComparer.Compare, a, b) }
+	byBacking := make(map[*fileBacking][]*fileMetadata)
+	for _, level := range v.Levels {
+		iter := level.Iter()
+		for f := iter.First(); f != nil; f = iter.Next() {
+			if f.FileBacking == nil {
+				continue
+			}
+			for _, g := range byBacking[f.FileBacking] {
+				if cmp(g.Smallest, f.Largest) <= 0 && cmp(f.Smallest, g.Largest) <= 0 {
+					return errors.Newf(
+						"file %s and %s share a FileBacking but overlap", g.FileNum, f.FileNum,
+					)
+				}
+			}
+			byBacking[f.FileBacking] = append(byBacking[f.FileBacking], f)
+		}
+	}
+	return nil
+}
+
+// RatchetFormatMajorVersion ratchets the opened database's format major
+// version to the provided version. It errors if the provided format
+// major version is less than the database's current format major
+// version.
+func (d *DB) RatchetFormatMajorVersion(formatVers FormatMajorVersion) (err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	from := d.mu.formatVers.vers
+	if from > formatVers {
+		return errors.Newf(
+			"pebble: database already at format major version %s; cannot reduce to %s",
+			from, formatVers,
+		)
+	}
+	d.opts.EventListener.FormatMajorVersionRatchetBegin(from, formatVers, planMigration(d, from, formatVers))
+	defer func() {
+		d.opts.EventListener.FormatMajorVersionRatchetEnd(from, formatVers, err)
+	}()
+	for nextVers := from + 1; nextVers <= formatVers; nextVers++ {
+		migrate, ok := formatMajorVersionMigrations[nextVers]
+		if !ok {
+			return errors.Newf("pebble: missing migration for format major version %s", nextVers)
+		}
+		if err := migrate(d); err != nil {
+			return errors.Wrapf(err, "migrating to version %s", nextVers)
+		}
+		d.opts.EventListener.FormatMajorVersionStepCompleted(nextVers)
+	}
+	return nil
+}
+
+// planMigration estimates the work that ratcheting from `from` to `to` will
+// perform, for reporting via FormatMajorVersionRatchetBegin. It is a rough,
+// best-effort estimate: the actual migrations re-derive their own work sets
+// at the time they run.
+func planMigration(d *DB, from, to FormatMajorVersion) MigrationPlan {
+	plan := MigrationPlan{From: from, To: to}
+	if from < FormatSplitUserKeysMarked && to >= FormatSplitUserKeysMarked {
+		d.mu.versions.logLock()
+		plan.MarkedForCompactionCount = len(markFilesWithSplitUserKeys(d.mu.versions.currentVersion()))
+		d.mu.versions.logUnlock()
+	}
+	if from < FormatBlockPropertyCollector && to >= FormatBlockPropertyCollector {
+		d.mu.versions.logLock()
+		for _, level := range d.mu.versions.currentVersion().Levels {
+			iter := level.Iter()
+			for f := iter.First(); f != nil; f = iter.Next() {
+				plan.BlockPropertyRecollectionCount++
+			}
+		}
+		d.mu.versions.logUnlock()
+	}
+	return plan
+}
+
+// DowngradeFormatMajorVersion downgrades the opened database's format major
+// version to target. Unlike RatchetFormatMajorVersion, a downgrade cannot be
+// performed as a single atomic bump of the on-disk marker: any sstable
+// written at a table format unavailable at target must first be rewritten at
+// an older table format before the marker is allowed to move backward.
+//
+// DowngradeFormatMajorVersion marks every such sstable as needing rewrite,
+// reusing the same Compact.MarkedFiles machinery introduced for
+// FormatMarkedCompacted, and schedules compactions to rewrite them. The
+// marker is only moved once no marked files remain and the WAL and manifest
+// have been drained of any record that only the newer format version can
+// represent. If a feature currently in use (e.g. range keys or block
+// properties) has no representation at target, DowngradeFormatMajorVersion
+// returns an *ErrUnsupportedDowngrade listing the offending files and leaves
+// the marker in place. When such a file is already on disk at the start, no
+// files are marked or rewritten; when it only appears with the flush that
+// drainNewerOnlyRecordsLocked forces, the rewrites before that flush have
+// already run.
+func (d *DB) DowngradeFormatMajorVersion(target FormatMajorVersion) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.mu.formatVers.vers <= target {
+		return nil
+	}
+
+	d.mu.versions.logLock()
+	offending, err := filesExceedingTableFormat(d.mu.versions.currentVersion(), target.MaxTableFormat())
+	d.mu.versions.logUnlock()
+	if err != nil {
+		return err
+	}
+	if blocked := blockingFeatures(d.mu.versions.currentVersion(), target); len(blocked) > 0 {
+		return &ErrUnsupportedDowngrade{Target: target, Files: blocked}
+	}
+
+	if err := d.markFilesLocked(markFilesFn(offending)); err != nil {
+		return errors.Wrap(err, "marking files for downgrade rewrite")
+	}
+	d.maybeScheduleCompactionLocked()
+
+	// The marker is moved backward only once compactions have drained
+	// every file that the target format version cannot represent, and
+	// the WAL/manifest no longer contain any record requiring a newer
+	// format. compactMarkedFilesLocked blocks until the marked files
+	// have all been rewritten at (or below) target.MaxTableFormat().
+	if err := d.compactMarkedFilesLocked(); err != nil {
+		return errors.Wrap(err, "rewriting files for downgrade")
+	}
+	if err := d.drainNewerOnlyRecordsLocked(target); err != nil {
+		return errors.Wrap(err, "draining WAL/manifest records incompatible with downgrade target")
+	}
+	return d.finalizeFormatVersUpgrade(target)
+}
+
+// ErrUnsupportedDowngrade is returned by DowngradeFormatMajorVersion when a
+// feature currently in use by the database (such as range keys or block
+// property collectors) has no representation at the requested target format
+// major version.
+type ErrUnsupportedDowngrade struct {
+	// Target is the format major version that was requested.
+	Target FormatMajorVersion
+	// Files lists the sstables that use a feature unavailable at Target.
+	Files []base.FileNum
+}
+
+// Error implements error.
+func (e *ErrUnsupportedDowngrade) Error() string {
+	return fmt.Sprintf(
+		"pebble: cannot downgrade to format major version %s: %d file(s) use a feature unavailable at that version",
+		e.Target, len(e.Files),
+	)
+}
+
+// filesExceedingTableFormat returns the file numbers of every sstable in v
+// whose on-disk TableFormat exceeds maxFormat.
+func filesExceedingTableFormat(v *version, maxFormat sstable.TableFormat) ([]base.FileNum, error) {
+	var exceeding []base.FileNum
+	for _, level := range v.Levels {
+		iter := level.Iter()
+		for f := iter.First(); f != nil; f = iter.Next() {
+			if f.TableFormat > maxFormat {
+				exceeding = append(exceeding, f.FileNum)
+			}
+		}
+	}
+	return exceeding, nil
+}
+
+// blockingFeatures returns the file numbers of sstables that use a feature
+// with no representation at target, and which therefore cannot be rewritten
+// down to target.MaxTableFormat() by a simple rewrite (e.g. range keys or
+// block-property collectors actually present in the data).
+func blockingFeatures(v *version, target FormatMajorVersion) []base.FileNum {
+	var blocked []base.FileNum
+	for _, level := range v.Levels {
+		iter := level.Iter()
+		for f := iter.First(); f != nil; f = iter.Next() {
+			if f.HasRangeKeys && target < FormatRangeKeys {
+				blocked = append(blocked, f.FileNum)
+				continue
+			}
+			if len(f.BlockPropertyCollectors) > 0 && target < FormatBlockPropertyCollector {
+				blocked = append(blocked, f.FileNum)
+				continue
+			}
+			if f.Virtual && target < FormatVirtualSSTables {
+				// A virtual file only references a sub-range of a shared
+				// FileBacking; rewriting it to an older table format
+				// would require first materializing it into its own
+				// physical sstable, which filesExceedingTableFormat's
+				// simple per-file rewrite does not do. Block the
+				// downgrade instead of silently mis-rewriting it.
+				blocked = append(blocked, f.FileNum)
+			}
+		}
+	}
+	return blocked
+}
+
+// markFilesFn adapts a precomputed list of file numbers into the file
+// selector signature expected by markFilesLocked, the same machinery used to
+// mark files during the FormatSplitUserKeysMarked migration.
+func markFilesFn(fileNums []base.FileNum) func(*version) []*fileMetadata {
+	set := make(map[base.FileNum]bool, len(fileNums))
+	for _, n := range fileNums {
+		set[n] = true
+	}
+	return func(v *version) []*fileMetadata {
+		var marked []*fileMetadata
+		for _, level := range v.Levels {
+			iter := level.Iter()
+			for f := iter.First(); f != nil; f = iter.Next() {
+				if set[f.FileNum] {
+					marked = append(marked, f)
+				}
+			}
+		}
+		return marked
+	}
+}
+
+// drainNewerOnlyRecordsLocked blocks until the WAL and manifest no longer
+// contain any record that only a format major version newer than target can
+// represent (for example, a range-key record when target < FormatRangeKeys).
+//
+// filesExceedingTableFormat and blockingFeatures, called earlier in
+// DowngradeFormatMajorVersion, only scan on-disk sstables in the current
+// version; they cannot see a record that is still sitting in the mutable
+// memtable (e.g. a range-key write that arrived after those checks ran but
+// before the flush that would turn it into an sstable). To close that race,
+// force a flush here so any such record becomes an on-disk file, and then
+// re-validate: if the flush surfaced a file the target format cannot
+// represent, mark and rewrite it before allowing the caller to move the
+// marker; if it surfaced a file using a feature target has no
+// representation for at all, fail the downgrade.
+func (d *DB) drainNewerOnlyRecordsLocked(target FormatMajorVersion) error {
+	d.mu.Unlock()
+	err := d.Flush()
+	d.mu.Lock()
+	if err != nil {
+		return errors.Wrap(err, "flushing to surface in-memory records before downgrade")
+	}
+
+	if blocked := blockingFeatures(d.mu.versions.currentVersion(), target); len(blocked) > 0 {
+		return &ErrUnsupportedDowngrade{Target: target, Files: blocked}
+	}
+	offending, err := filesExceedingTableFormat(d.mu.versions.currentVersion(), target.MaxTableFormat())
+	if err != nil {
+		return err
+	}
+	if len(offending) == 0 {
+		return nil
+	}
+	if err := d.markFilesLocked(markFilesFn(offending)); err != nil {
+		return errors.Wrap(err, "marking files surfaced by flush for downgrade rewrite")
+	}
+	d.maybeScheduleCompactionLocked()
+	return d.compactMarkedFilesLocked()
+}
+
+// RatchetPlan reports, for each intermediate format major version on the
+// path to a requested target, what RatchetFormatMajorVersion would need to
+// do to reach it.
+type RatchetPlan struct {
+	// Steps describes each intermediate migration that would run, in
+	// order, to reach the requested target.
+	Steps []RatchetStep
+}
+
+// RatchetStep describes the work a single step of a format-major-version
+// ratchet is expected to perform.
+type RatchetStep struct {
+	// From and To identify the migration step.
+	From, To FormatMajorVersion
+	// MarkedForCompactionCount is the number of files that would be
+	// marked for compaction by this step.
+	MarkedForCompactionCount int
+	// ManifestRotationRequired reports whether this step requires
+	// rotating to a new MANIFEST file.
+	ManifestRotationRequired bool
+	// MarkerMoveRequired reports whether this step would move the
+	// on-disk format-version marker.
+	MarkerMoveRequired bool
+	// Blocked, if non-empty, describes a condition that would need to be
+	// resolved before this step could run (for example, an in-progress
+	// compaction that must complete first).
+	Blocked string
+}
+
+// PlanFormatMajorVersionRatchet runs the read-only portions of each
+// intermediate migration that RatchetFormatMajorVersion(target) would
+// perform, without mutating the manifest, the format-version marker, or any
+// sstable. It allows operators to estimate the cost of a ratchet (how many
+// files would be rewritten, whether a manifest rotation or marker move would
+// occur) so that the ratchet itself can be scheduled during a maintenance
+// window.
+func (d *DB) PlanFormatMajorVersionRatchet(target FormatMajorVersion) (*RatchetPlan, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	from := d.mu.formatVers.vers
+	if from > target {
+		return nil, errors.Newf(
+			"pebble: database already at format major version %s; cannot plan a ratchet down to %s",
+			from, target,
+		)
+	}
+
+	plan := &RatchetPlan{}
+	for nextVers := from + 1; nextVers <= target; nextVers++ {
+		if _, ok := formatMajorVersionMigrations[nextVers]; !ok {
+			return nil, errors.Newf("pebble: missing migration for format major version %s", nextVers)
+		}
+		step := RatchetStep{From: nextVers - 1, To: nextVers}
+		if d.mu.compact.compactingCount > 0 {
+			step.Blocked = "a compaction is currently in progress"
+		}
+		switch nextVers {
+		case formatVersionedManifestMarker:
+			step.ManifestRotationRequired = true
+			step.MarkerMoveRequired = true
+		case FormatSplitUserKeysMarked:
+			step.MarkedForCompactionCount = len(markFilesWithSplitUserKeys(d.mu.versions.currentVersion()))
+			step.MarkerMoveRequired = true
+		case FormatVirtualSSTables:
+			if err := checkNoExistingFileBackingViolations(d.mu.versions.currentVersion()); err != nil {
+				step.Blocked = err.Error()
+			}
+			step.MarkerMoveRequired = true
+		default:
+			step.MarkerMoveRequired = true
+		}
+		plan.Steps = append(plan.Steps, step)
+	}
+	return plan, nil
+}
+
+// FormatMajorVersion returns the database's active format major version.
+// The format major version may be higher than the one provided in Options
+// when the database was opened if the database was previously written at
+// a higher format major version.
+func (d *DB) FormatMajorVersion() FormatMajorVersion {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.mu.formatVers.vers
+}
+
+// finalizeFormatVersUpgrade is typically called at the conclusion of a
+// format major version migration and is responsible for updating the
+// DB.mu.formatVers.vers field and persisting the format-version marker.
+func (d *DB) finalizeFormatVersUpgrade(formatVers FormatMajorVersion) error {
+	if err := d.mu.formatVers.marker.Move(fmt.Sprintf("%03d", formatVers)); err != nil {
+		return errors.Wrap(err, "moving format version marker")
+	}
+	d.mu.formatVers.vers = formatVers
+	return nil
+}
+
+// formatVersionMarkerName is the name used for the DB's format-version
+// marker.
+const formatVersionMarkerName = `format-version`
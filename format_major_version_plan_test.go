@@ -0,0 +1,83 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/internal/datadriven"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlanFormatMajorVersionRatchet(t *testing.T) {
+	var d *DB
+	var opts *Options
+	var fs vfs.FS
+	defer func() {
+		if d != nil {
+			require.NoError(t, d.Close())
+		}
+	}()
+
+	datadriven.RunTest(t, "testdata/plan_format_major_version_ratchet",
+		func(td *datadriven.TestData) string {
+			switch td.Cmd {
+			case "define":
+				if d != nil {
+					if err := d.Close(); err != nil {
+						return err.Error()
+					}
+				}
+				opts = &Options{
+					FormatMajorVersion:          FormatBlockPropertyCollector,
+					DisableAutomaticCompactions: true,
+				}
+				var err error
+				if d, err = runDBDefineCmd(td, opts); err != nil {
+					return err.Error()
+				}
+				fs = d.opts.FS
+				d.mu.Lock()
+				defer d.mu.Unlock()
+				return d.mu.versions.currentVersion().DebugString(base.DefaultFormatter)
+			case "plan":
+				v, err := strconv.Atoi(td.CmdArgs[0].String())
+				if err != nil {
+					return err.Error()
+				}
+				plan, err := d.PlanFormatMajorVersionRatchet(FormatMajorVersion(v))
+				if err != nil {
+					return err.Error()
+				}
+				var buf []byte
+				for _, step := range plan.Steps {
+					buf = append(buf, []byte(fmt.Sprintf(
+						"%s -> %s: marked=%d manifest-rotation=%t marker-move=%t blocked=%q\n",
+						step.From, step.To, step.MarkedForCompactionCount,
+						step.ManifestRotationRequired, step.MarkerMoveRequired, step.Blocked,
+					))...)
+				}
+				return string(buf)
+			case "ratchet-format-major-version":
+				v, err := strconv.Atoi(td.CmdArgs[0].String())
+				if err != nil {
+					return err.Error()
+				}
+				if err := d.RatchetFormatMajorVersion(FormatMajorVersion(v)); err != nil {
+					return err.Error()
+				}
+				return "OK"
+			case "marked-file-count":
+				m := d.Metrics()
+				return fmt.Sprintf("%d files marked for compaction", m.Compact.MarkedFiles)
+			default:
+				return fmt.Sprintf("unrecognized command %q", td.Cmd)
+			}
+		})
+}
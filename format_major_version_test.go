@@ -27,6 +27,52 @@ func TestFormatMajorVersion_MigrationDefined(t *testing.T) {
 	}
 }
 
+func TestFormatMajorVersionRange(t *testing.T) {
+	min, max := FormatMajorVersionRange()
+	require.Equal(t, FormatMostCompatible, min)
+	require.Equal(t, FormatNewest, max)
+
+	vers := SupportedFormatMajorVersions()
+	require.Equal(t, min, vers[0])
+	require.Equal(t, max, vers[len(vers)-1])
+	for i := 1; i < len(vers); i++ {
+		require.Equal(t, vers[i-1]+1, vers[i])
+	}
+}
+
+func TestFormatMajorVersion_Features(t *testing.T) {
+	require.False(t, FormatMostCompatible.Features().Has(FeatureRangeKeys))
+	require.True(t, FormatRangeKeys.Features().Has(FeatureRangeKeys))
+	require.True(t, FormatNewest.Features().Has(FeatureRangeKeys))
+	require.True(t, FormatVirtualSSTables.Features().Has(FeatureVirtualSSTables))
+}
+
+func TestCheckNoExistingFileBackingViolations(t *testing.T) {
+	key := func(userKey string, seqNum uint64) base.InternalKey {
+		return base.MakeInternalKey([]byte(userKey), seqNum, base.InternalKeyKindSet)
+	}
+
+	// Two files in the same level that share a FileBacking but cover
+	// disjoint key ranges satisfy the invariant.
+	disjointBacking := &fileBacking{FileNum: 10}
+	v := &version{}
+	v.Levels[6].files = []*fileMetadata{
+		{FileNum: 1, Smallest: key("a", 1), Largest: key("b", 2), FileBacking: disjointBacking},
+		{FileNum: 2, Smallest: key("c", 3), Largest: key("d", 4), FileBacking: disjointBacking},
+	}
+	require.NoError(t, checkNoExistingFileBackingViolations(v))
+
+	// Two files sharing a FileBacking whose key ranges overlap violate it,
+	// and must block a ratchet to FormatVirtualSSTables.
+	overlappingBacking := &fileBacking{FileNum: 20}
+	v = &version{}
+	v.Levels[6].files = []*fileMetadata{
+		{FileNum: 3, Smallest: key("a", 1), Largest: key("c", 2), FileBacking: overlappingBacking},
+		{FileNum: 4, Smallest: key("b", 3), Largest: key("d", 4), FileBacking: overlappingBacking},
+	}
+	require.Error(t, checkNoExistingFileBackingViolations(v))
+}
+
 func TestRatchetFormat(t *testing.T) {
 	fs := vfs.NewMem()
 	d, err := Open("", &Options{FS: fs})
@@ -41,8 +87,8 @@ func TestRatchetFormat(t *testing.T) {
 	require.Equal(t, FormatSetWithDelete, d.FormatMajorVersion())
 	require.NoError(t, d.RatchetFormatMajorVersion(FormatBlockPropertyCollector))
 	require.Equal(t, FormatBlockPropertyCollector, d.FormatMajorVersion())
-	require.NoError(t, d.RatchetFormatMajorVersion(FormatRangeKeys))
-	require.Equal(t, FormatRangeKeys, d.FormatMajorVersion())
+	require.NoError(t, d.RatchetFormatMajorVersion(FormatNewest))
+	require.Equal(t, FormatNewest, d.FormatMajorVersion())
 	require.NoError(t, d.Close())
 
 	// If we Open the database again, leaving the default format, the
@@ -63,7 +109,29 @@ func TestRatchetFormat(t *testing.T) {
 		FormatMajorVersion: FormatVersioned,
 	})
 	require.Error(t, err)
-	require.EqualError(t, err, `pebble: database "" written in format major version 999999`)
+	var incompatErr *IncompatibleFormatError
+	require.ErrorAs(t, err, &incompatErr)
+	require.Equal(t, FormatMajorVersion(999999), incompatErr.Stored)
+	min, max := FormatMajorVersionRange()
+	require.Equal(t, min, incompatErr.MinSupported)
+	require.Equal(t, max, incompatErr.MaxSupported)
+}
+
+// TestCheckFormatMajorVersionSupported exercises checkFormatMajorVersionSupported
+// directly, in isolation from the marker-reading and wrapping Open performs
+// around it (exercised end-to-end above by TestRatchetFormat).
+func TestCheckFormatMajorVersionSupported(t *testing.T) {
+	min, max := FormatMajorVersionRange()
+	require.NoError(t, checkFormatMajorVersionSupported(min))
+	require.NoError(t, checkFormatMajorVersionSupported(max))
+
+	err := checkFormatMajorVersionSupported(999999)
+	require.Error(t, err)
+	var incompatErr *IncompatibleFormatError
+	require.ErrorAs(t, err, &incompatErr)
+	require.Equal(t, FormatMajorVersion(999999), incompatErr.Stored)
+	require.Equal(t, min, incompatErr.MinSupported)
+	require.Equal(t, max, incompatErr.MaxSupported)
 }
 
 func testBasicDB(d *DB) error {
@@ -199,6 +267,8 @@ func TestFormatMajorVersions_TableFormat(t *testing.T) {
 		FormatSplitUserKeysMarked:     sstable.TableFormatPebblev1,
 		FormatMarkedCompacted:         sstable.TableFormatPebblev1,
 		FormatRangeKeys:               sstable.TableFormatPebblev2,
+		FormatSSTableValueBlocks:      sstable.TableFormatPebblev3,
+		FormatVirtualSSTables:         sstable.TableFormatPebblev3,
 	}
 
 	// Valid versions.
@@ -243,6 +313,15 @@ func TestSplitUserKeyMigration(t *testing.T) {
 							info.TotalDuration = 2 * time.Second
 							fmt.Fprintln(&buf, info)
 						},
+						FormatMajorVersionRatchetBegin: func(from, to FormatMajorVersion, plan MigrationPlan) {
+							fmt.Fprintf(&buf, "ratchet-begin: %s -> %s\n", from, to)
+						},
+						FormatMajorVersionStepCompleted: func(v FormatMajorVersion) {
+							fmt.Fprintf(&buf, "step-completed: %s\n", v)
+						},
+						FormatMajorVersionRatchetEnd: func(from, to FormatMajorVersion, err error) {
+							fmt.Fprintf(&buf, "ratchet-end: %s -> %s, err=%v\n", from, to, err)
+						},
 					},
 					DisableAutomaticCompactions: true,
 				}
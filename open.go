@@ -0,0 +1,68 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"strconv"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/pebble/vfs/atomicfs"
+)
+
+// manifestMarkerName is the name used for the DB's current-MANIFEST marker.
+const manifestMarkerName = `manifest`
+
+// Open opens a DB whose files live in the given directory.
+//
+// This is a reduced-scope reconstruction of Open, covering only the
+// format-major-version marker lifecycle that the rest of this package
+// depends on (see format_major_version.go); it does not reproduce the full
+// storage engine's WAL replay or manifest parsing.
+func Open(dirname string, opts *Options) (*DB, error) {
+	opts = opts.EnsureDefaults()
+
+	manifestMarker, _, err := atomicfs.LocateMarker(opts.FS, dirname, manifestMarkerName)
+	if err != nil {
+		return nil, err
+	}
+	formatVersMarker, formatVersStr, err := atomicfs.LocateMarker(opts.FS, dirname, formatVersionMarkerName)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &DB{dirname: dirname, opts: opts, manifestMarker: manifestMarker}
+	d.mu.formatVers.marker = formatVersMarker
+	d.mu.versions.manifestFileNum = 1
+
+	if formatVersStr == "" {
+		// A new store. Use the requested format major version, defaulting
+		// to the most compatible version if none was specified.
+		vers := opts.FormatMajorVersion
+		if vers == FormatDefault {
+			vers = FormatMostCompatible
+		}
+		if err := d.finalizeFormatVersUpgrade(vers); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+
+	storedVers, err := strconv.Atoi(formatVersStr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "pebble: database %q has corrupt format-version marker %q", dirname, formatVersStr)
+	}
+	stored := FormatMajorVersion(storedVers)
+	if err := checkFormatMajorVersionSupported(stored); err != nil {
+		return nil, errors.Wrapf(err, "pebble: database %q", dirname)
+	}
+	d.mu.formatVers.vers = stored
+
+	if opts.FormatMajorVersion > d.mu.formatVers.vers {
+		if err := d.RatchetFormatMajorVersion(opts.FormatMajorVersion); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
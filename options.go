@@ -0,0 +1,61 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import "github.com/cockroachdb/pebble/vfs"
+
+// Options holds the parameters configuring a DB.
+type Options struct {
+	// FS provides the filesystem the DB is stored on. If nil, vfs.Default
+	// is used.
+	FS vfs.FS
+	// EventListener is invoked for events occurring during the lifetime of
+	// the DB.
+	EventListener EventListener
+	// FormatMajorVersion sets the format major version for a new DB. Once
+	// a database is created with a particular format major version,
+	// RatchetFormatMajorVersion must be used to subsequently ratchet it
+	// to a newer one. If left unspecified, a new DB defaults to
+	// FormatMostCompatible, and an existing DB is opened at its
+	// previously persisted format major version.
+	FormatMajorVersion FormatMajorVersion
+	// DisableAutomaticCompactions disables automatic queued compactions.
+	// Used for testing and for scheduling ratchets/downgrades during
+	// explicit maintenance windows.
+	DisableAutomaticCompactions bool
+}
+
+// EnsureDefaults ensures that unset fields are set to sane defaults.
+func (o *Options) EnsureDefaults() *Options {
+	if o == nil {
+		o = &Options{}
+	}
+	if o.FS == nil {
+		o.FS = vfs.Default
+	}
+	o.EventListener.EnsureDefaults()
+	return o
+}
+
+// Clone creates a shallow copy of the Options.
+func (o *Options) Clone() *Options {
+	c := *o
+	return &c
+}
+
+// WriteOptions holds the optional parameters used during write operations.
+type WriteOptions struct {
+	// Sync is whether to sync writes through the OS buffer cache and down
+	// onto the actual disk.
+	Sync bool
+}
+
+// Sync configures a write to synchronously flush through the OS buffer
+// cache and down onto the actual disk.
+var Sync = &WriteOptions{Sync: true}
+
+// IterOptions holds the optional parameters used when constructing an
+// Iterator.
+type IterOptions struct{}